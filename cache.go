@@ -1,6 +1,12 @@
 package main
 
 import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"runtime"
 	"sync"
 	"time"
 )
@@ -9,140 +15,1120 @@ type CacheItem struct {
 	key     string
 	value   []byte
 	expires time.Time
-	next    *CacheItem
-	prev    *CacheItem
 }
 
+// Stats captures cumulative counters for a Cache's lifetime.
+type Stats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	Bytes       uint64
+}
+
+// Policy decides which key a full Cache should evict to make room for a
+// new entry, and tracks whatever access bookkeeping it needs to do so.
+// Implementations must be safe for concurrent use.
+type Policy interface {
+	// Touch records an access to (or insertion of) key.
+	Touch(key string)
+	// Evict selects, without removing, the key that should be evicted to
+	// make room for a new entry. ok is false if the policy has nothing to
+	// evict (e.g. it has never tracked any keys).
+	Evict() (key string, ok bool)
+	// Remove forgets any bookkeeping the policy holds for key.
+	Remove(key string)
+	// Admit decides whether candidate should be admitted in place of
+	// victim, the key Evict selected. Policies that always make room for
+	// new entries (LRU, FIFO, LFU) return true unconditionally; admission
+	// policies such as TinyLFU may decline and keep victim in the cache.
+	Admit(candidate, victim string) bool
+}
+
+// EvictReason distinguishes why an item left the cache, passed to any
+// callback registered via Cache.OnEvicted.
+type EvictReason int
+
+const (
+	Expired EvictReason = iota
+	CapacityEvicted
+	Deleted
+)
+
+// evictedEntry is a snapshot of a removed item, collected while c.mu is
+// held so the OnEvicted callback can be fired after the lock is released.
+type evictedEntry struct {
+	key    string
+	value  []byte
+	reason EvictReason
+}
+
+// cache holds the actual implementation. It is wrapped by the exported
+// Cache so a runtime.SetFinalizer can be attached to the wrapper: the
+// janitor goroutine below holds a reference to *cache, which would
+// otherwise keep it (and the finalizer) from ever running.
+type cache struct {
+	mu        sync.RWMutex
+	items     map[string]*CacheItem
+	capacity  int
+	policy    Policy
+	stats     Stats
+	onEvicted func(key string, value []byte, reason EvictReason)
+	janitor   *Janitor
+
+	loadMu    sync.Mutex
+	loadGroup map[string]*call
+}
+
+// Cache is a fixed-capacity, TTL-aware key/value store. Construct one with
+// NewCache, NewCacheWithPolicy, or NewCacheWithOptions.
 type Cache struct {
-	mu   sync.RWMutex
-	head *CacheItem
-	tail *CacheItem
-	stop chan struct{}
+	*cache
 }
 
 const CacheCapacity = 1000
 
 func NewCache() *Cache {
-	cache := &Cache{
-		stop: make(chan struct{}),
+	return NewCacheWithPolicy(CacheCapacity, NewLRUPolicy())
+}
+
+// DefaultCleanupInterval is the janitor interval NewCache and
+// NewCacheWithPolicy run with.
+const DefaultCleanupInterval = time.Second
+
+// NewCacheWithPolicy creates a Cache bounded at capacity entries whose
+// eviction decisions are delegated to policy, cleaned up on
+// DefaultCleanupInterval.
+func NewCacheWithPolicy(capacity int, policy Policy) *Cache {
+	return NewCacheWithOptions(Options{Capacity: capacity, Policy: policy, CleanupInterval: DefaultCleanupInterval})
+}
+
+// Options configures NewCacheWithOptions. Capacity defaults to
+// CacheCapacity and Policy to an LRUPolicy when left zero/nil.
+// CleanupInterval <= 0 (including the Go zero value, i.e. simply not
+// setting the field) disables the janitor entirely, which tests that
+// don't want a background goroutine running can rely on; pass
+// DefaultCleanupInterval for the same cadence NewCache uses. Context, if
+// set, lets the janitor be cancelled alongside some larger operation
+// instead of only through StopCleanup.
+type Options struct {
+	Capacity        int
+	Policy          Policy
+	CleanupInterval time.Duration
+	Context         context.Context
+}
+
+// NewCacheWithOptions creates a Cache from opts, applying the defaults
+// documented on Options for any zero-valued field.
+func NewCacheWithOptions(opts Options) *Cache {
+	if opts.Capacity <= 0 {
+		opts.Capacity = CacheCapacity
+	}
+	if opts.Policy == nil {
+		opts.Policy = NewLRUPolicy()
 	}
-	go cache.startCleanup()
-	return cache
+	if opts.Context == nil {
+		opts.Context = context.Background()
+	}
+
+	c := &cache{
+		items:     make(map[string]*CacheItem),
+		capacity:  opts.Capacity,
+		policy:    opts.Policy,
+		loadGroup: make(map[string]*call),
+	}
+	wrapper := &Cache{c}
+
+	if opts.CleanupInterval > 0 {
+		c.janitor = newJanitor(opts.Context, opts.CleanupInterval)
+		go c.janitor.run(c)
+		runtime.SetFinalizer(wrapper, stopJanitor)
+	}
+	return wrapper
 }
 
-func (c *Cache) Set(key []byte, value []byte, ttl time.Duration) {
+// stopJanitor is the runtime.SetFinalizer callback: if the caller drops
+// every reference to a Cache without calling StopCleanup, the garbage
+// collector runs this to stop the janitor goroutine anyway.
+func stopJanitor(c *Cache) {
+	c.StopCleanup()
+}
+
+func (c *cache) Set(key []byte, value []byte, ttl time.Duration) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	evicted := c.setLocked(string(key), value, ttl)
+	c.mu.Unlock()
+	c.fireEvicted(evicted)
+}
 
-	keyStr := string(key)
+// setLocked performs the insert-or-update half of Set, including capacity
+// eviction. Callers must hold c.mu and are responsible for firing the
+// returned evictions once it is released.
+func (c *cache) setLocked(keyStr string, value []byte, ttl time.Duration) []evictedEntry {
 	currentTime := time.Now()
 	expirationTime := currentTime.Add(ttl)
 
-	item := &CacheItem{
-		key:     keyStr,
-		value:   value,
-		expires: expirationTime,
+	if item, ok := c.items[keyStr]; ok {
+		c.stats.Bytes += uint64(len(value)) - uint64(len(item.value))
+		item.value = value
+		item.expires = expirationTime
+		c.policy.Touch(keyStr)
+		return nil
 	}
 
-	if c.head == nil {
-		c.head = item
-		c.tail = item
-	} else {
-		item.next = c.head
-		c.head.prev = item
-		c.head = item
-
-		if count := c.countItems(); count > CacheCapacity {
-			c.removeOldestExpired()
+	var evicted []evictedEntry
+	if len(c.items) >= c.capacity {
+		if victim, ok := c.policy.Evict(); ok {
+			if !c.policy.Admit(keyStr, victim) {
+				// Policy declined to make room; the candidate is dropped
+				// rather than evicting victim.
+				return nil
+			}
+			if e, ok := c.removeKeyLocked(victim, CapacityEvicted); ok {
+				evicted = append(evicted, e)
+			}
+			c.stats.Evictions++
 		}
 	}
+
+	c.items[keyStr] = &CacheItem{key: keyStr, value: value, expires: expirationTime}
+	c.stats.Bytes += uint64(len(value))
+	c.policy.Touch(keyStr)
+	return evicted
+}
+
+// SetString is a convenience wrapper around Set for string keys and values.
+func (c *cache) SetString(key string, value string, ttl time.Duration) {
+	c.Set([]byte(key), []byte(value), ttl)
+}
+
+func (c *cache) Get(key []byte) (value []byte, ttl time.Duration) {
+	c.mu.Lock()
+
+	keyStr := string(key)
+	item, ok := c.items[keyStr]
+	if !ok {
+		c.stats.Misses++
+		c.mu.Unlock()
+		return nil, 0
+	}
+
+	currentTime := time.Now()
+	if item.expires.Before(currentTime) {
+		e, _ := c.removeKeyLocked(keyStr, Expired)
+		c.stats.Expirations++
+		c.stats.Misses++
+		c.mu.Unlock()
+		c.fireEvicted([]evictedEntry{e})
+		return nil, 0
+	}
+
+	c.policy.Touch(keyStr)
+	c.stats.Hits++
+	c.mu.Unlock()
+	return item.value, item.expires.Sub(currentTime)
+}
+
+// GetString is a convenience wrapper around Get for string keys and values.
+func (c *cache) GetString(key string) (value string, ttl time.Duration) {
+	v, ttl := c.Get([]byte(key))
+	return string(v), ttl
+}
+
+// ErrKeyExists is returned by Add when key is already present and unexpired.
+var ErrKeyExists = errors.New("cache: key already exists")
+
+// ErrKeyNotFound is returned by Replace when key is absent or expired.
+var ErrKeyNotFound = errors.New("cache: key not found")
+
+// Add sets key only if it is not already present (or has expired),
+// returning ErrKeyExists otherwise.
+func (c *cache) Add(key []byte, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	keyStr := string(key)
+	if item, ok := c.items[keyStr]; ok && item.expires.After(time.Now()) {
+		c.mu.Unlock()
+		return ErrKeyExists
+	}
+	evicted := c.setLocked(keyStr, value, ttl)
+	c.mu.Unlock()
+	c.fireEvicted(evicted)
+	return nil
+}
+
+// Replace sets key only if it is already present and unexpired, returning
+// ErrKeyNotFound otherwise.
+func (c *cache) Replace(key []byte, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	keyStr := string(key)
+	item, ok := c.items[keyStr]
+	if !ok || item.expires.Before(time.Now()) {
+		c.mu.Unlock()
+		return ErrKeyNotFound
+	}
+	evicted := c.setLocked(keyStr, value, ttl)
+	c.mu.Unlock()
+	c.fireEvicted(evicted)
+	return nil
+}
+
+// call is an in-flight GetOrLoad invocation that other callers requesting
+// the same key wait on, modeled on golang.org/x/sync/singleflight.
+type call struct {
+	wg    sync.WaitGroup
+	value []byte
+	err   error
+}
+
+// GetOrLoad returns key's cached value, or, on a miss, runs loader exactly
+// once even under concurrent calls for the same key: the first caller runs
+// loader and stores its result with ttl, while concurrent callers wait for
+// and share that result instead of each running loader themselves.
+func (c *cache) GetOrLoad(key []byte, ttl time.Duration, loader func() ([]byte, error)) ([]byte, error) {
+	if value, _ := c.Get(key); value != nil {
+		return value, nil
+	}
+
+	keyStr := string(key)
+
+	c.loadMu.Lock()
+	if inFlight, ok := c.loadGroup[keyStr]; ok {
+		c.loadMu.Unlock()
+		inFlight.wg.Wait()
+		return inFlight.value, inFlight.err
+	}
+
+	inFlight := &call{}
+	inFlight.wg.Add(1)
+	c.loadGroup[keyStr] = inFlight
+	c.loadMu.Unlock()
+
+	value, err := loader()
+	if err == nil {
+		c.Set(key, value, ttl)
+	}
+	inFlight.value, inFlight.err = value, err
+	inFlight.wg.Done()
+
+	c.loadMu.Lock()
+	delete(c.loadGroup, keyStr)
+	c.loadMu.Unlock()
+
+	return value, err
+}
+
+// Delete removes key from the cache, if present.
+func (c *cache) Delete(key []byte) {
+	c.mu.Lock()
+	e, ok := c.removeKeyLocked(string(key), Deleted)
+	c.mu.Unlock()
+	if ok {
+		c.fireEvicted([]evictedEntry{e})
+	}
+}
+
+// OnEvicted registers fn to be called whenever an item leaves the cache,
+// whether through expiration, capacity eviction, or explicit deletion. fn
+// runs outside the cache lock, so it may safely call back into the cache
+// (e.g. to re-Set a value) without deadlocking.
+func (c *cache) OnEvicted(fn func(key string, value []byte, reason EvictReason)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onEvicted = fn
 }
 
-func (c *Cache) Get(key []byte) (value []byte, ttl time.Duration) {
+// Len returns the number of items currently held in the cache.
+func (c *cache) Len() int {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
+	return len(c.items)
+}
 
-	keyStr := string(key)
+// Stats returns a snapshot of the cache's cumulative counters.
+func (c *cache) Stats() Stats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.stats
+}
+
+// gobEntry is the on-disk representation of a cache entry used by Save
+// and Load. Expires is stored as an absolute time rather than a remaining
+// TTL so Load can tell how stale a snapshot is regardless of how long it
+// sat on disk.
+type gobEntry struct {
+	Key     string
+	Value   []byte
+	Expires time.Time
+}
+
+// Save writes every live (non-expired) entry to w using encoding/gob,
+// recording each entry's absolute expiration so Load can skip anything
+// that has since expired.
+func (c *cache) Save(w io.Writer) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	currentTime := time.Now()
+	entries := make([]gobEntry, 0, len(c.items))
+	for _, item := range c.items {
+		if item.expires.Before(currentTime) {
+			continue
+		}
+		entries = append(entries, gobEntry{Key: item.key, Value: item.value, Expires: item.expires})
+	}
+
+	return gob.NewEncoder(w).Encode(entries)
+}
+
+// SaveFile is a convenience wrapper around Save that writes to path.
+func (c *cache) SaveFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.Save(f)
+}
+
+// Load reads entries written by Save and inserts them, skipping any whose
+// stored absolute expiration has already passed. Each entry is routed
+// through setLocked, the same capacity-aware path Set uses, so loading a
+// snapshot larger than the cache's capacity evicts down to capacity
+// instead of growing past it.
+func (c *cache) Load(r io.Reader) error {
+	var entries []gobEntry
+	if err := gob.NewDecoder(r).Decode(&entries); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	currentTime := time.Now()
+	var evicted []evictedEntry
+	for _, e := range entries {
+		if e.Expires.Before(currentTime) {
+			continue
+		}
+		evicted = append(evicted, c.setLocked(e.Key, e.Value, e.Expires.Sub(currentTime))...)
+	}
+	c.mu.Unlock()
+	c.fireEvicted(evicted)
+	return nil
+}
+
+// LoadFile is a convenience wrapper around Load that reads from path.
+func (c *cache) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.Load(f)
+}
+
+// removeExpired sweeps every item for expiry. Eviction order says nothing
+// about expiry, so the whole map must be checked rather than stopping at
+// the first unexpired entry. Callers must hold c.mu.
+func (c *cache) removeExpired() []evictedEntry {
 	currentTime := time.Now()
-	for item := c.head; item != nil; item = item.next {
-		if item.key == keyStr {
-			if item.expires.After(currentTime) {
-				return item.value, item.expires.Sub(currentTime)
+	var evicted []evictedEntry
+	for key, item := range c.items {
+		if item.expires.Before(currentTime) {
+			if e, ok := c.removeKeyLocked(key, Expired); ok {
+				evicted = append(evicted, e)
 			}
-			// Item has expired, remove it
-			c.removeCacheItem(item)
+			c.stats.Expirations++
 		}
 	}
+	return evicted
+}
+
+// removeKeyLocked deletes key from the item map and forgets it in the
+// policy, returning a snapshot for the OnEvicted callback. Callers must
+// hold c.mu.
+func (c *cache) removeKeyLocked(key string, reason EvictReason) (evictedEntry, bool) {
+	item, ok := c.items[key]
+	if !ok {
+		return evictedEntry{}, false
+	}
+	delete(c.items, key)
+	c.policy.Remove(key)
+	c.stats.Bytes -= uint64(len(item.value))
+	return evictedEntry{key: key, value: item.value, reason: reason}, true
+}
+
+// fireEvicted invokes the OnEvicted callback, if any, for each entry. It
+// must be called without c.mu held: collecting evictions into a slice
+// while the lock is held, then firing callbacks after releasing it, avoids
+// re-entrancy deadlocks if a callback calls back into the cache.
+func (c *cache) fireEvicted(entries []evictedEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	c.mu.RLock()
+	cb := c.onEvicted
+	c.mu.RUnlock()
+	if cb == nil {
+		return
+	}
+	for _, e := range entries {
+		cb(e.key, e.value, e.reason)
+	}
+}
+
+// StopCleanup stops the cache's janitor goroutine, if one is running. It
+// is safe to call more than once (e.g. from both a deferred call and the
+// finalizer installed by NewCacheWithOptions).
+func (c *cache) StopCleanup() {
+	if c.janitor != nil {
+		c.janitor.stop()
+	}
+}
+
+// Janitor periodically sweeps a cache for expired entries until its
+// context is cancelled, either by the owning Cache's StopCleanup or by
+// the Context passed to NewCacheWithOptions being cancelled.
+type Janitor struct {
+	Interval time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
 
-	return nil, 0
+func newJanitor(parent context.Context, interval time.Duration) *Janitor {
+	ctx, cancel := context.WithCancel(parent)
+	return &Janitor{Interval: interval, ctx: ctx, cancel: cancel}
 }
 
-func (c *Cache) startCleanup() {
-	ticker := time.NewTicker(time.Second)
+func (j *Janitor) run(c *cache) {
+	ticker := time.NewTicker(j.Interval)
 	defer ticker.Stop()
 	for {
 		select {
-		case <-c.stop:
+		case <-j.ctx.Done():
 			return
 		case <-ticker.C:
 			c.mu.Lock()
-			c.removeExpired()
+			evicted := c.removeExpired()
 			c.mu.Unlock()
+			c.fireEvicted(evicted)
 		}
 	}
 }
 
-func (c *Cache) removeExpired() {
-	currentTime := time.Now()
-	for item := c.head; item != nil; {
-		if item.expires.Before(currentTime) {
-			nextItem := item.next
-			c.removeCacheItem(item)
-			item = nextItem
-		} else {
-			break
+// stop cancels the janitor's context, ending its run loop. Safe to call
+// more than once.
+func (j *Janitor) stop() {
+	j.cancel()
+}
+
+// keyNode is an intrusive doubly linked list node used by keyList.
+type keyNode struct {
+	key  string
+	prev *keyNode
+	next *keyNode
+}
+
+// keyList is a minimal doubly linked list of cache keys, shared by
+// LRUPolicy (recency order) and FIFOPolicy (insertion order).
+type keyList struct {
+	nodes map[string]*keyNode
+	head  *keyNode
+	tail  *keyNode
+}
+
+func newKeyList() *keyList {
+	return &keyList{nodes: make(map[string]*keyNode)}
+}
+
+// pushFront inserts key at the front if it isn't already tracked.
+func (l *keyList) pushFront(key string) {
+	if _, ok := l.nodes[key]; ok {
+		return
+	}
+	n := &keyNode{key: key, next: l.head}
+	if l.head != nil {
+		l.head.prev = n
+	}
+	l.head = n
+	if l.tail == nil {
+		l.tail = n
+	}
+	l.nodes[key] = n
+}
+
+// moveToFront promotes key to the front, inserting it if not yet tracked.
+func (l *keyList) moveToFront(key string) {
+	n, ok := l.nodes[key]
+	if !ok {
+		l.pushFront(key)
+		return
+	}
+	if n == l.head {
+		return
+	}
+	l.unlink(n)
+	n.prev = nil
+	n.next = l.head
+	if l.head != nil {
+		l.head.prev = n
+	}
+	l.head = n
+	if l.tail == nil {
+		l.tail = n
+	}
+}
+
+func (l *keyList) unlink(n *keyNode) {
+	if n == l.head {
+		l.head = n.next
+	}
+	if n == l.tail {
+		l.tail = n.prev
+	}
+	if n.next != nil {
+		n.next.prev = n.prev
+	}
+	if n.prev != nil {
+		n.prev.next = n.next
+	}
+	n.next = nil
+	n.prev = nil
+}
+
+func (l *keyList) remove(key string) {
+	n, ok := l.nodes[key]
+	if !ok {
+		return
+	}
+	l.unlink(n)
+	delete(l.nodes, key)
+}
+
+// back returns the key at the tail of the list (the eviction candidate).
+func (l *keyList) back() (string, bool) {
+	if l.tail == nil {
+		return "", false
+	}
+	return l.tail.key, true
+}
+
+// LRUPolicy evicts the least recently touched key.
+type LRUPolicy struct {
+	mu   sync.Mutex
+	list *keyList
+}
+
+func NewLRUPolicy() *LRUPolicy {
+	return &LRUPolicy{list: newKeyList()}
+}
+
+func (p *LRUPolicy) Touch(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.list.moveToFront(key)
+}
+
+func (p *LRUPolicy) Evict() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.list.back()
+}
+
+func (p *LRUPolicy) Remove(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.list.remove(key)
+}
+
+func (p *LRUPolicy) Admit(candidate, victim string) bool {
+	return true
+}
+
+// FIFOPolicy evicts whichever key was inserted first, ignoring access
+// patterns entirely.
+type FIFOPolicy struct {
+	mu   sync.Mutex
+	list *keyList
+}
+
+func NewFIFOPolicy() *FIFOPolicy {
+	return &FIFOPolicy{list: newKeyList()}
+}
+
+// Touch only records the key's insertion position; later touches of an
+// already-tracked key do not reorder it.
+func (p *FIFOPolicy) Touch(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.list.pushFront(key)
+}
+
+func (p *FIFOPolicy) Evict() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.list.back()
+}
+
+func (p *FIFOPolicy) Remove(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.list.remove(key)
+}
+
+func (p *FIFOPolicy) Admit(candidate, victim string) bool {
+	return true
+}
+
+// LFUPolicy evicts the least frequently touched key, using the classic
+// O(1) frequency-bucket scheme (ties broken by recency within a bucket).
+type LFUPolicy struct {
+	mu      sync.Mutex
+	freq    map[string]int
+	buckets map[int]*keyList
+	minFreq int
+}
+
+func NewLFUPolicy() *LFUPolicy {
+	return &LFUPolicy{
+		freq:    make(map[string]int),
+		buckets: make(map[int]*keyList),
+	}
+}
+
+func (p *LFUPolicy) Touch(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	oldFreq, tracked := p.freq[key]
+	newFreq := oldFreq + 1
+	p.freq[key] = newFreq
+
+	if tracked {
+		p.buckets[oldFreq].remove(key)
+		if p.buckets[oldFreq].head == nil {
+			delete(p.buckets, oldFreq)
+			if oldFreq == p.minFreq {
+				p.minFreq = newFreq
+			}
+		}
+	} else {
+		p.minFreq = newFreq
+	}
+
+	if p.buckets[newFreq] == nil {
+		p.buckets[newFreq] = newKeyList()
+	}
+	p.buckets[newFreq].pushFront(key)
+}
+
+func (p *LFUPolicy) Evict() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	bucket := p.buckets[p.minFreq]
+	if bucket == nil {
+		return "", false
+	}
+	return bucket.back()
+}
+
+func (p *LFUPolicy) Remove(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, ok := p.freq[key]
+	if !ok {
+		return
+	}
+	p.buckets[f].remove(key)
+	if p.buckets[f].head == nil {
+		delete(p.buckets, f)
+	}
+	delete(p.freq, key)
+}
+
+func (p *LFUPolicy) Admit(candidate, victim string) bool {
+	return true
+}
+
+// fnv1a hashes key with the 64-bit FNV-1a algorithm.
+func fnv1a(key string) uint64 {
+	const offsetBasis uint64 = 14695981039346656037
+	const prime uint64 = 1099511628211
+
+	h := offsetBasis
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= prime
+	}
+	return h
+}
+
+// countMinSketch is a compact, probabilistic frequency estimator: 4 rows of
+// 4-bit (capped at 15) counters indexed by independent hashes of the key.
+type countMinSketch struct {
+	width    uint64
+	counters [4][]uint8
+	seeds    [4]uint64
+}
+
+func newCountMinSketch(width uint64) *countMinSketch {
+	if width == 0 {
+		width = 1
+	}
+	s := &countMinSketch{
+		width: width,
+		seeds: [4]uint64{0x9e3779b97f4a7c15, 0xbf58476d1ce4e5b9, 0x94d049bb133111eb, 0xff51afd7ed558ccd},
+	}
+	for i := range s.counters {
+		s.counters[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *countMinSketch) indexes(key string) [4]uint64 {
+	h := fnv1a(key)
+	var idx [4]uint64
+	for i, seed := range s.seeds {
+		idx[i] = (h ^ seed) % s.width
+	}
+	return idx
+}
+
+func (s *countMinSketch) add(key string) {
+	for i, idx := range s.indexes(key) {
+		if s.counters[i][idx] < 15 {
+			s.counters[i][idx]++
+		}
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	min := uint8(15)
+	for i, idx := range s.indexes(key) {
+		if c := s.counters[i][idx]; c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// age halves every counter, preventing long-lived keys from saturating
+// their counters and permanently outranking newer, genuinely hotter keys.
+func (s *countMinSketch) age() {
+	for _, row := range s.counters {
+		for i := range row {
+			row[i] /= 2
+		}
+	}
+}
+
+// doorkeeper is a small bloom filter that gates entry into the count-min
+// sketch: a key must be seen twice (once to set its bit, once to find it
+// already set) before it starts accumulating sketch frequency. This keeps
+// one-hit wonders from polluting admission decisions.
+type doorkeeper struct {
+	bits    []uint64
+	bitSize uint64
+}
+
+func newDoorkeeper(size uint64) *doorkeeper {
+	if size == 0 {
+		size = 1
+	}
+	return &doorkeeper{bits: make([]uint64, (size+63)/64), bitSize: size}
+}
+
+func (d *doorkeeper) indexes(key string) [2]uint64 {
+	h1 := fnv1a(key)
+	h2 := fnv1a(key + "\x00doorkeeper")
+	return [2]uint64{h1 % d.bitSize, h2 % d.bitSize}
+}
+
+func (d *doorkeeper) has(key string) bool {
+	for _, idx := range d.indexes(key) {
+		if d.bits[idx/64]&(1<<(idx%64)) == 0 {
+			return false
 		}
 	}
+	return true
+}
+
+func (d *doorkeeper) set(key string) {
+	for _, idx := range d.indexes(key) {
+		d.bits[idx/64] |= 1 << (idx % 64)
+	}
+}
+
+func (d *doorkeeper) reset() {
+	for i := range d.bits {
+		d.bits[i] = 0
+	}
+}
+
+// tinyLFUAgingInterval is how many Touch calls TinyLFUPolicy allows before
+// halving its sketch counters (see countMinSketch.age).
+const tinyLFUAgingInterval = 10000
+
+// TinyLFUPolicy implements W-TinyLFU admission on top of an LRU eviction
+// list: a count-min sketch estimates access frequency, a doorkeeper bloom
+// filter shields the sketch from one-hit wonders, and Admit only lets a
+// new key evict the current LRU victim if it is estimated to be hotter.
+type TinyLFUPolicy struct {
+	mu      sync.Mutex
+	lru     *keyList
+	sketch  *countMinSketch
+	door    *doorkeeper
+	touches int
+}
+
+// NewTinyLFUPolicy sizes the sketch and doorkeeper to roughly 10x capacity,
+// the ratio recommended for W-TinyLFU's count-min sketch.
+func NewTinyLFUPolicy(capacity int) *TinyLFUPolicy {
+	width := uint64(capacity * 10)
+	if width < 16 {
+		width = 16
+	}
+	return &TinyLFUPolicy{
+		lru:    newKeyList(),
+		sketch: newCountMinSketch(width),
+		door:   newDoorkeeper(width),
+	}
+}
+
+func (p *TinyLFUPolicy) Touch(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lru.moveToFront(key)
+	p.recordAccess(key)
+}
+
+// recordAccess feeds key through the doorkeeper and count-min sketch.
+// Called on every Touch, and also from Admit for a rejected candidate so
+// repeatedly-requested-but-never-admitted keys still accumulate frequency
+// and can eventually win admission. Callers must hold p.mu.
+func (p *TinyLFUPolicy) recordAccess(key string) {
+	if !p.door.has(key) {
+		p.door.set(key)
+	} else {
+		p.sketch.add(key)
+	}
+
+	p.touches++
+	if p.touches >= tinyLFUAgingInterval {
+		p.sketch.age()
+		p.door.reset()
+		p.touches = 0
+	}
+}
+
+func (p *TinyLFUPolicy) Evict() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lru.back()
+}
+
+func (p *TinyLFUPolicy) Remove(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lru.remove(key)
+}
+
+// Admit assumes the caller (setLocked) only invokes it when Evict already
+// reported a real victim via its ok return; "" is a valid cache key, so it
+// can't double as a sentinel for "no victim" here.
+func (p *TinyLFUPolicy) Admit(candidate, victim string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	admit := p.sketch.estimate(candidate) > p.sketch.estimate(victim)
+	if !admit {
+		// A successful admission gets its frequency recorded by the Touch
+		// that follows it; record it here instead only when rejecting, so
+		// a repeatedly-rejected candidate still accumulates frequency and
+		// can eventually win admission, without double-counting the keys
+		// that are admitted on the first try.
+		p.recordAccess(candidate)
+	}
+	return admit
+}
+
+// DefaultShardCount is the number of shards ShardedCache uses unless told
+// otherwise, chosen to keep contention low under typical concurrency.
+const DefaultShardCount = 256
+
+// ShardedCache spreads entries across several independent Cache instances,
+// each with its own mutex, so concurrent readers and writers touching
+// different keys never contend on a single global lock.
+type ShardedCache struct {
+	shards []*Cache
+	mask   uint64
+}
+
+// NewShardedCache creates a ShardedCache holding roughly capacity entries
+// in total, spread evenly across shards shards (rounded up to the next
+// power of two so key-to-shard routing can use a bitmask).
+func NewShardedCache(capacity, shards int) *ShardedCache {
+	if shards <= 0 {
+		shards = DefaultShardCount
+	}
+	shards = nextPowerOfTwo(shards)
+
+	perShardCapacity := capacity / shards
+	if perShardCapacity < 1 {
+		perShardCapacity = 1
+	}
+
+	sc := &ShardedCache{
+		shards: make([]*Cache, shards),
+		mask:   uint64(shards - 1),
+	}
+	for i := range sc.shards {
+		sc.shards[i] = NewCacheWithPolicy(perShardCapacity, NewLRUPolicy())
+	}
+	return sc
+}
+
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+func (sc *ShardedCache) shardFor(key []byte) *Cache {
+	return sc.shards[fnv1a(string(key))&sc.mask]
+}
+
+func (sc *ShardedCache) Set(key []byte, value []byte, ttl time.Duration) {
+	sc.shardFor(key).Set(key, value, ttl)
+}
+
+func (sc *ShardedCache) Get(key []byte) (value []byte, ttl time.Duration) {
+	return sc.shardFor(key).Get(key)
+}
+
+// Delete removes key from whichever shard owns it, if present.
+func (sc *ShardedCache) Delete(key []byte) {
+	sc.shardFor(key).Delete(key)
+}
+
+// Add sets key only if it is not already present (or has expired) in the
+// shard that owns it; see Cache.Add.
+func (sc *ShardedCache) Add(key []byte, value []byte, ttl time.Duration) error {
+	return sc.shardFor(key).Add(key, value, ttl)
+}
+
+// Replace sets key only if it is already present and unexpired in the
+// shard that owns it; see Cache.Replace.
+func (sc *ShardedCache) Replace(key []byte, value []byte, ttl time.Duration) error {
+	return sc.shardFor(key).Replace(key, value, ttl)
 }
 
-func (c *Cache) removeOldestExpired() {
-	for item := c.tail; item != nil; item = item.prev {
-		if item.expires.Before(time.Now()) {
-			c.removeCacheItem(item)
-			break
+// GetOrLoad delegates to the shard that owns key; see Cache.GetOrLoad.
+func (sc *ShardedCache) GetOrLoad(key []byte, ttl time.Duration, loader func() ([]byte, error)) ([]byte, error) {
+	return sc.shardFor(key).GetOrLoad(key, ttl, loader)
+}
+
+// Len returns the total number of items held across every shard.
+func (sc *ShardedCache) Len() int {
+	n := 0
+	for _, shard := range sc.shards {
+		n += shard.Len()
+	}
+	return n
+}
+
+// Stats returns the sum of every shard's cumulative counters.
+func (sc *ShardedCache) Stats() Stats {
+	var total Stats
+	for _, shard := range sc.shards {
+		s := shard.Stats()
+		total.Hits += s.Hits
+		total.Misses += s.Misses
+		total.Evictions += s.Evictions
+		total.Expirations += s.Expirations
+		total.Bytes += s.Bytes
+	}
+	return total
+}
+
+// SaveFile writes every shard's live entries into a single gob-encoded
+// file at path; see Cache.Save.
+func (sc *ShardedCache) SaveFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	currentTime := time.Now()
+	var entries []gobEntry
+	for _, shard := range sc.shards {
+		shard.mu.RLock()
+		for _, item := range shard.items {
+			if item.expires.Before(currentTime) {
+				continue
+			}
+			entries = append(entries, gobEntry{Key: item.key, Value: item.value, Expires: item.expires})
 		}
+		shard.mu.RUnlock()
 	}
+
+	return gob.NewEncoder(f).Encode(entries)
 }
 
-func (c *Cache) removeCacheItem(item *CacheItem) {
-	if item == c.head {
-		c.head = item.next
+// LoadFile reads a file written by SaveFile, routing each entry through
+// the shard that owns its key so per-shard capacity is respected; see
+// Cache.Load.
+func (sc *ShardedCache) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
 	}
-	if item == c.tail {
-		c.tail = item.prev
+	defer f.Close()
+
+	var entries []gobEntry
+	if err := gob.NewDecoder(f).Decode(&entries); err != nil {
+		return err
 	}
-	if item.next != nil {
-		item.next.prev = item.prev
+
+	currentTime := time.Now()
+	byShard := make(map[*Cache][]gobEntry, len(sc.shards))
+	for _, e := range entries {
+		if e.Expires.Before(currentTime) {
+			continue
+		}
+		shard := sc.shardFor([]byte(e.Key))
+		byShard[shard] = append(byShard[shard], e)
 	}
-	if item.prev != nil {
-		item.prev.next = item.next
+
+	for shard, shardEntries := range byShard {
+		shard.mu.Lock()
+		var evicted []evictedEntry
+		for _, e := range shardEntries {
+			evicted = append(evicted, shard.setLocked(e.Key, e.Value, e.Expires.Sub(currentTime))...)
+		}
+		shard.mu.Unlock()
+		shard.fireEvicted(evicted)
 	}
+	return nil
 }
 
-func (c *Cache) StopCleanup() {
-	close(c.stop)
+// StopCleanup stops every shard's janitor goroutine.
+func (sc *ShardedCache) StopCleanup() {
+	for _, shard := range sc.shards {
+		shard.StopCleanup()
+	}
 }
 
-func (c *Cache) countItems() int {
-	count := 0
-	for item := c.head; item != nil; item = item.next {
-		count++
+// OnEvicted registers fn on every shard; see Cache.OnEvicted.
+func (sc *ShardedCache) OnEvicted(fn func(key string, value []byte, reason EvictReason)) {
+	for _, shard := range sc.shards {
+		shard.OnEvicted(fn)
 	}
-	return count
 }
 
 func main() {
-	cache := NewCache()
+	cache := NewShardedCache(CacheCapacity, DefaultShardCount)
 	defer cache.StopCleanup()
 
 	cache.Set([]byte("DJ"), []byte("Dante J"), 5*time.Second)
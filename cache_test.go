@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func benchmarkCacheGetConcurrent(b *testing.B, ttl time.Duration) {
+	cache := NewCache()
+	defer cache.StopCleanup()
+	cache.SetString("foo", "bar", ttl)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cache.GetString("foo")
+		}
+	})
+}
+
+func BenchmarkCacheGetConcurrentExpiring(b *testing.B) {
+	benchmarkCacheGetConcurrent(b, time.Millisecond)
+}
+
+func BenchmarkCacheGetConcurrentNotExpiring(b *testing.B) {
+	benchmarkCacheGetConcurrent(b, time.Hour)
+}
+
+func BenchmarkCacheSetConcurrent(b *testing.B) {
+	cache := NewCache()
+	defer cache.StopCleanup()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cache.SetString("key"+strconv.Itoa(i%1000), "value", time.Minute)
+			i++
+		}
+	})
+}
+
+// BenchmarkShardedCacheSetConcurrent is the ShardedCache counterpart to
+// BenchmarkCacheSetConcurrent, so the single-mutex-contention cost the
+// sharding was meant to avoid shows up as a measurable difference between
+// the two benchmarks under `go test -bench`.
+func BenchmarkShardedCacheSetConcurrent(b *testing.B) {
+	sc := NewShardedCache(CacheCapacity, DefaultShardCount)
+	defer sc.StopCleanup()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			sc.Set([]byte("key"+strconv.Itoa(i%1000)), []byte("value"), time.Minute)
+			i++
+		}
+	})
+}
+
+func TestLRUPolicyEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewCacheWithOptions(Options{Capacity: 2, Policy: NewLRUPolicy()})
+	defer c.StopCleanup()
+
+	c.SetString("a", "1", time.Minute)
+	c.SetString("b", "2", time.Minute)
+	c.GetString("a") // a is now more recently used than b
+	c.SetString("c", "3", time.Minute)
+
+	if v, _ := c.GetString("b"); v != "" {
+		t.Fatalf("expected b to be evicted as the LRU victim, got %q", v)
+	}
+	if v, _ := c.GetString("a"); v != "1" {
+		t.Fatalf("expected a to survive eviction, got %q", v)
+	}
+	if v, _ := c.GetString("c"); v != "3" {
+		t.Fatalf("expected c to be cached, got %q", v)
+	}
+}
+
+func TestFIFOPolicyEvictsOldestInsertion(t *testing.T) {
+	c := NewCacheWithOptions(Options{Capacity: 2, Policy: NewFIFOPolicy()})
+	defer c.StopCleanup()
+
+	c.SetString("a", "1", time.Minute)
+	c.SetString("b", "2", time.Minute)
+	c.GetString("a") // FIFO ignores access order
+	c.SetString("c", "3", time.Minute)
+
+	if v, _ := c.GetString("a"); v != "" {
+		t.Fatalf("expected a, the first inserted, to be evicted, got %q", v)
+	}
+	if v, _ := c.GetString("b"); v != "2" {
+		t.Fatalf("expected b to still be cached, got %q", v)
+	}
+}
+
+func TestLFUPolicyEvictsLeastFrequentlyUsed(t *testing.T) {
+	c := NewCacheWithOptions(Options{Capacity: 2, Policy: NewLFUPolicy()})
+	defer c.StopCleanup()
+
+	c.SetString("a", "1", time.Minute)
+	c.SetString("b", "2", time.Minute)
+	c.GetString("a")
+	c.GetString("a") // a accessed more often than b
+	c.SetString("c", "3", time.Minute)
+
+	if v, _ := c.GetString("b"); v != "" {
+		t.Fatalf("expected b, the least frequently used, to be evicted, got %q", v)
+	}
+	if v, _ := c.GetString("a"); v != "1" {
+		t.Fatalf("expected a to still be cached, got %q", v)
+	}
+}
+
+func TestLFUPolicyPrunesEmptyBuckets(t *testing.T) {
+	p := NewLFUPolicy()
+	p.Touch("hot")
+	for i := 0; i < 100; i++ {
+		p.Touch("hot")
+	}
+
+	if got := len(p.buckets); got != 1 {
+		t.Fatalf("expected stale frequency buckets to be pruned, got %d buckets left behind", got)
+	}
+}
+
+func TestTinyLFUPolicyRejectsColdCandidateOverHotVictim(t *testing.T) {
+	c := NewCacheWithOptions(Options{Capacity: 1, Policy: NewTinyLFUPolicy(8)})
+	defer c.StopCleanup()
+
+	c.SetString("hot", "1", time.Minute)
+	for i := 0; i < 5; i++ {
+		c.GetString("hot")
+	}
+
+	c.SetString("cold", "2", time.Minute) // cold candidate should be rejected
+
+	if v, _ := c.GetString("hot"); v != "1" {
+		t.Fatalf("expected hot to survive admission, got %q", v)
+	}
+	if v, _ := c.GetString("cold"); v != "" {
+		t.Fatalf("expected cold to be rejected, got %q", v)
+	}
+}
+
+// TestTinyLFUPolicyEmptyStringKeyIsNotTreatedAsNoVictim guards against a
+// regression where Admit used victim == "" as a sentinel for "no eviction
+// candidate," which let a genuine "" cache key bypass admission entirely.
+func TestTinyLFUPolicyEmptyStringKeyIsNotTreatedAsNoVictim(t *testing.T) {
+	c := NewCacheWithOptions(Options{Capacity: 1, Policy: NewTinyLFUPolicy(8)})
+	defer c.StopCleanup()
+
+	c.SetString("", "1", time.Minute)
+	for i := 0; i < 20; i++ {
+		c.GetString("")
+	}
+
+	c.SetString("cold", "2", time.Minute) // single-touch candidate should be rejected
+
+	if v, _ := c.GetString(""); v != "1" {
+		t.Fatalf("expected the hot \"\" key to survive admission, got %q", v)
+	}
+	if v, _ := c.GetString("cold"); v != "" {
+		t.Fatalf("expected cold to be rejected, got %q", v)
+	}
+}
+
+// TestTinyLFUPolicyAdmitDoesNotDoubleCount guards against a regression
+// where Admit recorded the candidate's frequency itself and the Touch that
+// follows a successful admission recorded it again, inflating freshly
+// admitted keys relative to keys inserted with capacity to spare.
+func TestTinyLFUPolicyAdmitDoesNotDoubleCount(t *testing.T) {
+	policy := NewTinyLFUPolicy(8)
+
+	// Two manual accesses: the first only sets the candidate's doorkeeper
+	// bit, the second bumps its sketch counter to 1.
+	policy.recordAccess("candidate")
+	policy.recordAccess("candidate")
+
+	if !policy.Admit("candidate", "victim") {
+		t.Fatal("expected candidate (freq 1) to be admitted over victim (freq 0)")
+	}
+	// Mirrors setLocked: Touch is called once for the key that was just
+	// admitted.
+	policy.Touch("candidate")
+
+	if got := policy.sketch.estimate("candidate"); got != 2 {
+		t.Fatalf("expected one Admit (no recordAccess) + one Touch (+1) to leave the count at 2, got %d", got)
+	}
+}
+
+func TestCacheSaveLoadRoundTrip(t *testing.T) {
+	c := NewCacheWithOptions(Options{Capacity: 10})
+	defer c.StopCleanup()
+	c.SetString("a", "1", time.Minute)
+	c.SetString("b", "2", time.Minute)
+
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	loaded := NewCacheWithOptions(Options{Capacity: 10})
+	defer loaded.StopCleanup()
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if v, _ := loaded.GetString("a"); v != "1" {
+		t.Fatalf("expected a=1 after round trip, got %q", v)
+	}
+	if v, _ := loaded.GetString("b"); v != "2" {
+		t.Fatalf("expected b=2 after round trip, got %q", v)
+	}
+}
+
+func TestCacheLoadSkipsExpiredEntries(t *testing.T) {
+	c := NewCacheWithOptions(Options{Capacity: 10})
+	defer c.StopCleanup()
+	c.SetString("stale", "1", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	loaded := NewCacheWithOptions(Options{Capacity: 10})
+	defer loaded.StopCleanup()
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if loaded.Len() != 0 {
+		t.Fatalf("expected an already-expired entry to be skipped by Save, got Len()=%d", loaded.Len())
+	}
+}
+
+// TestCacheLoadRespectsCapacity guards against a regression where Load
+// inserted every decoded entry directly into the item map, bypassing the
+// capacity-aware eviction path Set uses and leaving the cache arbitrarily
+// larger than its configured capacity.
+func TestCacheLoadRespectsCapacity(t *testing.T) {
+	source := NewCacheWithOptions(Options{Capacity: 10})
+	defer source.StopCleanup()
+	for i := 0; i < 10; i++ {
+		source.SetString("key"+strconv.Itoa(i), "value", time.Minute)
+	}
+
+	var buf bytes.Buffer
+	if err := source.Save(&buf); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	loaded := NewCacheWithOptions(Options{Capacity: 2})
+	defer loaded.StopCleanup()
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if got := loaded.Len(); got > 2 {
+		t.Fatalf("expected Load to respect Capacity: 2, got Len()=%d", got)
+	}
+}
+
+// TestCacheGetOrLoadDedupesConcurrentLoads drives many concurrent misses
+// for the same key through GetOrLoad and asserts loader runs exactly once,
+// guarding the thundering-herd guarantee the request asked for.
+func TestCacheGetOrLoadDedupesConcurrentLoads(t *testing.T) {
+	c := NewCache()
+	defer c.StopCleanup()
+
+	var loaderCalls int64
+	const callers = 50
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([][]byte, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-release
+			v, err := c.GetOrLoad([]byte("k"), time.Minute, func() ([]byte, error) {
+				atomic.AddInt64(&loaderCalls, 1)
+				return []byte("v"), nil
+			})
+			if err != nil {
+				t.Errorf("GetOrLoad: %v", err)
+				return
+			}
+			results[i] = v
+		}(i)
+	}
+	close(release)
+	wg.Wait()
+
+	if loaderCalls != 1 {
+		t.Fatalf("expected loader to run exactly once, ran %d times", loaderCalls)
+	}
+	for i, v := range results {
+		if string(v) != "v" {
+			t.Fatalf("caller %d got %q, want %q", i, v, "v")
+		}
+	}
+}
+
+func TestCacheAddRejectsExistingKey(t *testing.T) {
+	c := NewCache()
+	defer c.StopCleanup()
+
+	if err := c.Add([]byte("k"), []byte("1"), time.Minute); err != nil {
+		t.Fatalf("first Add: %v", err)
+	}
+	if err := c.Add([]byte("k"), []byte("2"), time.Minute); err != ErrKeyExists {
+		t.Fatalf("expected ErrKeyExists, got %v", err)
+	}
+	if v, _ := c.GetString("k"); v != "1" {
+		t.Fatalf("expected rejected Add to leave the original value, got %q", v)
+	}
+}
+
+func TestCacheAddAllowedAfterExpiry(t *testing.T) {
+	c := NewCache()
+	defer c.StopCleanup()
+
+	if err := c.Add([]byte("k"), []byte("1"), time.Millisecond); err != nil {
+		t.Fatalf("first Add: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := c.Add([]byte("k"), []byte("2"), time.Minute); err != nil {
+		t.Fatalf("expected Add to succeed once the key has expired, got %v", err)
+	}
+	if v, _ := c.GetString("k"); v != "2" {
+		t.Fatalf("expected the post-expiry value, got %q", v)
+	}
+}
+
+func TestCacheReplaceRejectsMissingKey(t *testing.T) {
+	c := NewCache()
+	defer c.StopCleanup()
+
+	if err := c.Replace([]byte("k"), []byte("1"), time.Minute); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	if err := c.Add([]byte("k"), []byte("1"), time.Minute); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := c.Replace([]byte("k"), []byte("2"), time.Minute); err != nil {
+		t.Fatalf("Replace: %v", err)
+	}
+	if v, _ := c.GetString("k"); v != "2" {
+		t.Fatalf("expected Replace to update the value, got %q", v)
+	}
+}
+
+func TestCacheOnEvictedReasons(t *testing.T) {
+	c := NewCacheWithOptions(Options{Capacity: 1})
+	defer c.StopCleanup()
+
+	var mu sync.Mutex
+	reasons := make(map[string]EvictReason)
+	c.OnEvicted(func(key string, value []byte, reason EvictReason) {
+		mu.Lock()
+		defer mu.Unlock()
+		reasons[key] = reason
+	})
+
+	c.SetString("capacity-victim", "1", time.Minute)
+	c.SetString("new", "2", time.Minute) // evicts capacity-victim
+
+	c.SetString("deleted", "3", time.Minute)
+	c.Delete([]byte("deleted"))
+
+	c.SetString("expired", "4", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	c.GetString("expired") // Get on an expired key triggers the callback
+
+	mu.Lock()
+	defer mu.Unlock()
+	cases := map[string]EvictReason{
+		"capacity-victim": CapacityEvicted,
+		"deleted":         Deleted,
+		"expired":         Expired,
+	}
+	for key, want := range cases {
+		got, ok := reasons[key]
+		if !ok {
+			t.Errorf("expected OnEvicted to fire for %q", key)
+			continue
+		}
+		if got != want {
+			t.Errorf("key %q: got reason %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestJanitorStopsOnContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := NewCacheWithOptions(Options{Capacity: 10, CleanupInterval: time.Millisecond, Context: ctx})
+
+	c.SetString("stale", "1", time.Millisecond)
+	cancel()
+
+	// Give the janitor goroutine a moment to observe ctx.Done() and return;
+	// removeExpired should no longer run afterwards.
+	time.Sleep(20 * time.Millisecond)
+	c.SetString("unrelated", "2", time.Minute)
+	time.Sleep(20 * time.Millisecond)
+
+	if got := c.Len(); got != 2 {
+		t.Fatalf("expected the cancelled janitor to leave the stale entry uncollected, got Len()=%d", got)
+	}
+}
+
+func TestCleanupIntervalZeroDisablesJanitor(t *testing.T) {
+	c := NewCacheWithOptions(Options{Capacity: 10})
+	defer c.StopCleanup()
+
+	if c.janitor != nil {
+		t.Fatal("expected the zero-value CleanupInterval to leave the janitor nil")
+	}
+}
+
+func TestShardedCacheSetGetDeleteAddReplaceGetOrLoad(t *testing.T) {
+	sc := NewShardedCache(1000, 4)
+	defer sc.StopCleanup()
+
+	sc.Set([]byte("a"), []byte("1"), time.Minute)
+	if v, _ := sc.Get([]byte("a")); string(v) != "1" {
+		t.Fatalf("expected a=1, got %q", v)
+	}
+
+	sc.Delete([]byte("a"))
+	if v, _ := sc.Get([]byte("a")); v != nil {
+		t.Fatalf("expected a to be gone after Delete, got %q", v)
+	}
+
+	if err := sc.Add([]byte("b"), []byte("1"), time.Minute); err != nil {
+		t.Fatalf("first Add: %v", err)
+	}
+	if err := sc.Add([]byte("b"), []byte("2"), time.Minute); err != ErrKeyExists {
+		t.Fatalf("expected ErrKeyExists, got %v", err)
+	}
+	if err := sc.Replace([]byte("b"), []byte("3"), time.Minute); err != nil {
+		t.Fatalf("Replace: %v", err)
+	}
+	if v, _ := sc.Get([]byte("b")); string(v) != "3" {
+		t.Fatalf("expected b=3 after Replace, got %q", v)
+	}
+	if err := sc.Replace([]byte("missing"), []byte("x"), time.Minute); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	v, err := sc.GetOrLoad([]byte("c"), time.Minute, func() ([]byte, error) {
+		return []byte("loaded"), nil
+	})
+	if err != nil || string(v) != "loaded" {
+		t.Fatalf("GetOrLoad: got %q, %v", v, err)
+	}
+
+	// Spread a few hundred keys across shards so Len/Stats have to
+	// aggregate across more than one shard's worth of entries.
+	for i := 0; i < 200; i++ {
+		sc.Set([]byte("key"+strconv.Itoa(i)), []byte("v"), time.Minute)
+	}
+	if got := sc.Len(); got != 202 {
+		t.Fatalf("expected Len to total every shard, got %d", got)
+	}
+
+	stats := sc.Stats()
+	if stats.Hits == 0 {
+		t.Fatal("expected Stats to aggregate hits across shards")
+	}
+}
+
+func TestShardedCacheSaveLoadFileRoundTrip(t *testing.T) {
+	sc := NewShardedCache(100, 4)
+	defer sc.StopCleanup()
+	for i := 0; i < 50; i++ {
+		sc.Set([]byte("key"+strconv.Itoa(i)), []byte("v"), time.Minute)
+	}
+
+	path := filepath.Join(t.TempDir(), "snapshot.gob")
+	if err := sc.SaveFile(path); err != nil {
+		t.Fatalf("SaveFile: %v", err)
+	}
+
+	loaded := NewShardedCache(100, 4)
+	defer loaded.StopCleanup()
+	if err := loaded.LoadFile(path); err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+
+	if got := loaded.Len(); got != 50 {
+		t.Fatalf("expected every entry to survive the round trip, got Len()=%d", got)
+	}
+	if v, _ := loaded.Get([]byte("key7")); string(v) != "v" {
+		t.Fatalf("expected key7=v after round trip, got %q", v)
+	}
+}